@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// filter decides, for a path relative to the root being walked, whether it
+// should be skipped. A directory that is skipped is not descended into, so
+// excluding e.g. ".git" or "node_modules" prunes the whole subtree, and an
+// -include pattern can't resurrect anything under it: skip is never even
+// asked about paths beneath a pruned directory, since findFilesRel stops
+// descending before reaching them.
+//
+// A path is skipped if it matches an exclude pattern and no include pattern
+// overrides that, the same precedence rclone's filter flags use.
+type filter struct {
+	includes []string
+	excludes []string
+}
+
+// skip reports whether relPath (slash-separated, relative to the root
+// passed to findFiles) should be excluded.
+func (f *filter) skip(relPath string) bool {
+	if f == nil {
+		return false
+	}
+
+	if !matchesAny(f.excludes, relPath) {
+		return false
+	}
+
+	return !matchesAny(f.includes, relPath)
+}
+
+// matchesAny reports whether relPath matches any of patterns. A pattern
+// with no "/" in it is also matched against relPath's base name alone, so
+// that e.g. "*.o" excludes object files at any depth the way a .gitignore
+// entry would, not just at the root.
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if matched, _ := path.Match(pattern, path.Base(relPath)); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readPatternsFile reads one glob pattern per line, as accepted by
+// -exclude/-include, from path. Blank lines and lines starting with "#" are
+// ignored, in keeping with .gitignore convention.
+func readPatternsFile(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pattern file: %s: %s", path,
+			err.Error())
+	}
+	defer func() { _ = fh.Close() }()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read pattern file: %s: %s", path,
+			err.Error())
+	}
+
+	return patterns, nil
+}
+
+// stringList is a flag.Value that collects repeated occurrences of a flag
+// into a slice, for -include and -exclude.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileInfo describes a file or directory found on an FS. It is satisfied by
+// os.FileInfo, so localFS needs no wrapping.
+type FileInfo interface {
+	Name() string
+	Size() int64
+	Mode() os.FileMode
+	ModTime() time.Time
+	IsDir() bool
+}
+
+// FS abstracts the filesystem operations findFiles and hashFile need, so
+// that a tree living somewhere other than the local disk (a tar archive,
+// say) can be walked and hashed the same way.
+type FS interface {
+	// Open opens the file at path for reading.
+	Open(path string) (io.ReadCloser, error)
+
+	// Stat returns file info for path.
+	Stat(path string) (FileInfo, error)
+
+	// ReadDir returns the names of the entries in the directory at path.
+	ReadDir(path string) ([]string, error)
+}
+
+// localFS is an FS backed by the local filesystem, via the os package. It
+// is what this program has always used.
+type localFS struct{}
+
+func (localFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localFS) Stat(path string) (FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localFS) ReadDir(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+
+	return fh.Readdirnames(0)
+}
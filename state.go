@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stateEntry is what's recorded per file in a -state file: enough to tell,
+// on a later -resume run, whether the file has changed since it was last
+// hashed, and with what algorithm.
+type stateEntry struct {
+	size     int64
+	modTime  time.Time
+	hashName string
+	hex      string
+}
+
+// loadStateFile reads a state file written by stateWriter, returning the
+// recorded entry for each file by its output path. A missing file is not
+// an error; it just means there is nothing to resume from yet.
+func loadStateFile(path string) (map[string]stateEntry, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]stateEntry{}, nil
+		}
+		return nil, fmt.Errorf("unable to open state file: %s: %s", path,
+			err.Error())
+	}
+	defer func() { _ = fh.Close() }()
+
+	entries := map[string]stateEntry{}
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unable to parse state file line: %q", line)
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse state file line: %q: %s", line,
+				err.Error())
+		}
+
+		modTimeNano, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse state file line: %q: %s", line,
+				err.Error())
+		}
+
+		entries[fields[0]] = stateEntry{
+			size:     size,
+			modTime:  time.Unix(0, modTimeNano),
+			hashName: fields[3],
+			hex:      fields[4],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read state file: %s: %s", path,
+			err.Error())
+	}
+
+	return entries, nil
+}
+
+// stateSyncEvery is how many appended entries stateWriter batches between
+// fsyncs. A run interrupted between syncs loses at most this many
+// already-hashed files from the state file, not the whole run.
+const stateSyncEvery = 20
+
+// stateWriter appends completed entries to a state file from a single
+// goroutine, so that concurrent hashing workers can report results without
+// their writes interleaving.
+type stateWriter struct {
+	requests chan stateWriteRequest
+	done     chan error
+}
+
+type stateWriteRequest struct {
+	path  string
+	entry stateEntry
+}
+
+// newStateWriter opens (creating if necessary) the state file at path for
+// appending and starts its writer goroutine.
+func newStateWriter(path string) (*stateWriter, error) {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state file: %s: %s", path,
+			err.Error())
+	}
+
+	w := &stateWriter{
+		requests: make(chan stateWriteRequest),
+		done:     make(chan error, 1),
+	}
+
+	go func() {
+		defer func() { _ = fh.Close() }()
+
+		unsynced := 0
+		var firstErr error
+
+		for req := range w.requests {
+			if firstErr != nil {
+				continue
+			}
+
+			line := fmt.Sprintf("%s\t%d\t%d\t%s\t%s\n", req.path, req.entry.size,
+				req.entry.modTime.UnixNano(), req.entry.hashName, req.entry.hex)
+
+			if _, err := fh.WriteString(line); err != nil {
+				firstErr = err
+				continue
+			}
+
+			unsynced++
+			if unsynced >= stateSyncEvery {
+				if err := fh.Sync(); err != nil {
+					firstErr = err
+					continue
+				}
+				unsynced = 0
+			}
+		}
+
+		if firstErr == nil && unsynced > 0 {
+			firstErr = fh.Sync()
+		}
+
+		w.done <- firstErr
+	}()
+
+	return w, nil
+}
+
+// record appends a completed entry for path. It must not be called after
+// close.
+func (w *stateWriter) record(path string, entry stateEntry) {
+	w.requests <- stateWriteRequest{path: path, entry: entry}
+}
+
+// close waits for all pending writes and a final fsync to complete, and
+// returns the first error encountered while writing, if any.
+func (w *stateWriter) close() error {
+	close(w.requests)
+	return <-w.done
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// tarFS is an FS that walks a tar archive as if it were a directory tree,
+// without extracting it first. This is handy for checksumming a backup
+// that only exists as a tarball, the same way Docker's tarsum walks an
+// image layer.
+type tarFS struct {
+	archivePath string
+
+	// entries maps a cleaned, slash-separated path (relative to the
+	// archive root, with no leading "/") to its tar header and the byte
+	// offset of its data within the archive.
+	entries map[string]tarEntry
+
+	// children maps a directory's cleaned path to the names of its
+	// immediate children.
+	children map[string][]string
+}
+
+type tarEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// newTarFS indexes the tar archive at archivePath so it can be queried as
+// an FS. It reads through the whole archive once up front; Open then seeks
+// straight to the member requested instead of re-reading from the start.
+func newTarFS(archivePath string) (*tarFS, error) {
+	fh, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open tar archive: %s: %s", archivePath,
+			err.Error())
+	}
+	defer func() { _ = fh.Close() }()
+
+	t := &tarFS{
+		archivePath: archivePath,
+		entries:     map[string]tarEntry{},
+		children:    map[string][]string{},
+	}
+
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tar archive: %s: %s", archivePath,
+				err.Error())
+		}
+
+		offset, err := fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		name := normalizeTarPath(hdr.Name)
+		t.entries[name] = tarEntry{header: hdr, offset: offset}
+		t.addChild(name)
+	}
+
+	return t, nil
+}
+
+// addChild records name as a child of its parent directory, and ensures
+// every ancestor directory up to the root is itself known as a child of
+// its own parent, since tar archives aren't required to contain explicit
+// entries for every intermediate directory.
+func (t *tarFS) addChild(name string) {
+	for name != "." {
+		dir := path.Dir(name)
+		base := path.Base(name)
+
+		already := false
+		for _, child := range t.children[dir] {
+			if child == base {
+				already = true
+				break
+			}
+		}
+		if !already {
+			t.children[dir] = append(t.children[dir], base)
+		}
+
+		name = dir
+	}
+}
+
+// normalizeTarPath cleans a tar member name into the slash-separated,
+// leading-slash-free form used as a key into entries and children, with
+// "." denoting the archive root.
+func normalizeTarPath(name string) string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if len(name) == 0 {
+		return "."
+	}
+	return name
+}
+
+func (t *tarFS) Open(p string) (io.ReadCloser, error) {
+	name := normalizeTarPath(p)
+
+	entry, ok := t.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("not found in tar archive: %s", p)
+	}
+
+	fh, err := os.Open(t.archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fh.Seek(entry.offset, io.SeekStart); err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+
+	return &tarMemberReader{
+		LimitedReader: io.LimitedReader{R: fh, N: entry.header.Size},
+		fh:            fh,
+	}, nil
+}
+
+// tarMemberReader limits reads to a single tar member's data while still
+// closing the underlying archive file handle when done.
+type tarMemberReader struct {
+	io.LimitedReader
+	fh *os.File
+}
+
+func (r *tarMemberReader) Close() error {
+	return r.fh.Close()
+}
+
+func (t *tarFS) Stat(p string) (FileInfo, error) {
+	name := normalizeTarPath(p)
+
+	if name == "." {
+		return tarRootInfo{}, nil
+	}
+
+	entry, ok := t.entries[name]
+	if ok {
+		return tarFileInfo{header: entry.header}, nil
+	}
+
+	// A directory with no explicit tar entry of its own, but that we saw
+	// referenced as the parent of some other entry.
+	if _, ok := t.children[name]; ok {
+		return tarSyntheticDirInfo{name: path.Base(name)}, nil
+	}
+
+	return nil, fmt.Errorf("not found in tar archive: %s", p)
+}
+
+func (t *tarFS) ReadDir(p string) ([]string, error) {
+	return t.children[normalizeTarPath(p)], nil
+}
+
+// tarFileInfo adapts a *tar.Header to FileInfo.
+type tarFileInfo struct {
+	header *tar.Header
+}
+
+func (i tarFileInfo) Name() string       { return path.Base(i.header.Name) }
+func (i tarFileInfo) Size() int64        { return i.header.Size }
+func (i tarFileInfo) Mode() os.FileMode  { return i.header.FileInfo().Mode() }
+func (i tarFileInfo) ModTime() time.Time { return i.header.ModTime }
+func (i tarFileInfo) IsDir() bool        { return i.header.Typeflag == tar.TypeDir }
+
+// tarSyntheticDirInfo stands in for a directory that has children in the
+// archive but no tar entry of its own.
+type tarSyntheticDirInfo struct {
+	name string
+}
+
+func (i tarSyntheticDirInfo) Name() string       { return i.name }
+func (i tarSyntheticDirInfo) Size() int64        { return 0 }
+func (i tarSyntheticDirInfo) Mode() os.FileMode  { return os.ModeDir }
+func (i tarSyntheticDirInfo) ModTime() time.Time { return time.Time{} }
+func (i tarSyntheticDirInfo) IsDir() bool        { return true }
+
+// tarRootInfo stands in for the archive root itself.
+type tarRootInfo struct{}
+
+func (tarRootInfo) Name() string       { return "." }
+func (tarRootInfo) Size() int64        { return 0 }
+func (tarRootInfo) Mode() os.FileMode  { return os.ModeDir }
+func (tarRootInfo) ModTime() time.Time { return time.Time{} }
+func (tarRootInfo) IsDir() bool        { return true }
@@ -11,89 +11,454 @@
 // hosts. rsync's --checksum flag ends up leading to a timeout due to how long
 // it takes to generate the file list. I intend to run this offline and then
 // resolve whatever differences there are separately.
+//
+// As an alternative to comparing two runs by hand, you can pass -check with
+// a checksum file produced by a previous run (or by sha1sum/md5sum) and this
+// program will walk -dir itself and report MISSING, EXTRA, and CHANGED
+// entries, similar to running sha1sum -c against a remote tree without
+// having to copy both trees to the same host.
+//
+// By default it hashes with MD5, but -hash selects any of the algorithms in
+// hashAlgorithms. Produced output starts with a header line recording which
+// one was used so that -check can detect it automatically on the other
+// side.
+//
+// -dir is normally a directory on the local filesystem, but -tar points
+// this at a tar archive instead: -dir is then a path within the archive
+// (the archive root if empty), and files are read out of it without first
+// extracting it to disk. See the FS interface for how backends other than
+// the local filesystem plug in.
+//
+// On a large enough tree a run can take long enough that getting
+// interrupted partway through is a real risk. Passing -state records each
+// file's checksum as it's computed, and a later run with -resume against
+// the same -state file skips anything already recorded with the same -hash
+// whose size and mtime haven't changed, so the work doesn't have to start
+// over.
 package main
 
 import (
 	"bufio"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"flag"
 	"fmt"
+	"hash"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 )
 
+// headerPrefix marks the first line of output as identifying the hash
+// algorithm used to produce it, e.g. "# tree_compare v1 hash=sha256".
+const headerPrefix = "# tree_compare v1 hash="
+
+// hashAlgorithms maps the name accepted by -hash to a constructor for that
+// hash.Hash. It's limited to the stdlib's crypto hashes: this module has no
+// go.mod and pulls in no dependencies, so faster or more collision-resistant
+// options like BLAKE3 or xxhash, which live outside the standard library,
+// aren't available here without taking on a dependency manager first.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 func main() {
 	dir := flag.String("dir", "", "Path to root directory to begin checks.")
+	check := flag.String("check", "",
+		"Path to a checksum file to verify -dir against instead of printing "+
+			"checksums. Accepts this program's own output format as well as "+
+			"sha1sum/md5sum's.")
+	missingOnSrc := flag.Bool("missing-on-src", true,
+		"In -check mode, report files found under -dir that are not present "+
+			"in the checksum file (EXTRA).")
+	missingOnDst := flag.Bool("missing-on-dst", true,
+		"In -check mode, report files present in the checksum file that are "+
+			"not found under -dir (MISSING).")
+	hashName := flag.String("hash", "md5",
+		"Hash algorithm to use: md5, sha1, sha256, or sha512. In -check mode "+
+			"this is only a fallback, used when the checksum file has no "+
+			"header recording the algorithm it was produced with.")
+	numWorkers := flag.Int("j", runtime.NumCPU(),
+		"Number of files to hash concurrently.")
+	tarPath := flag.String("tar", "",
+		"Path to a tar archive to walk instead of the local filesystem. -dir "+
+			"is then a path within the archive rather than on disk.")
+
+	var includes, excludes stringList
+	flag.Var(&includes, "include",
+		"Glob pattern (relative to -dir) to include, overriding -exclude for "+
+			"that file. Since an excluded directory is pruned and never "+
+			"descended into, this can't resurrect a file inside one: "+
+			"-exclude .git -include .git/config still drops .git/config. May "+
+			"be given multiple times.")
+	flag.Var(&excludes, "exclude",
+		"Glob pattern (relative to -dir) to exclude, pruning matched "+
+			"directories instead of descending into them. May be given "+
+			"multiple times.")
+	excludeFrom := flag.String("exclude-from", "",
+		"Path to a file of -exclude patterns, one per line. Blank lines and "+
+			"lines starting with # are ignored.")
+	statePath := flag.String("state", "",
+		"Path to a file to append path/size/mtime/checksum records to as "+
+			"each file is hashed, so an interrupted run can pick up where it "+
+			"left off. Only used when producing checksums, not with -check.")
+	resume := flag.Bool("resume", false,
+		"Skip re-hashing files already recorded in -state whose size and "+
+			"mtime are unchanged and that were hashed with the same -hash. "+
+			"Requires -state.")
 
 	flag.Parse()
 
-	if len(*dir) == 0 {
+	if len(*dir) == 0 && len(*tarPath) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if err := runChecks(*dir); err != nil {
+	if *resume && len(*statePath) == 0 {
+		log.Print("-resume requires -state")
+		os.Exit(1)
+	}
+
+	if len(*statePath) > 0 && len(*check) > 0 {
+		log.Print("-state and -resume are not used in -check mode")
+		os.Exit(1)
+	}
+
+	if len(*excludeFrom) > 0 {
+		patterns, err := readPatternsFile(*excludeFrom)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+		excludes = append(excludes, patterns...)
+	}
+
+	f := &filter{includes: includes, excludes: excludes}
+
+	var fsys FS = localFS{}
+	if len(*tarPath) > 0 {
+		tfs, err := newTarFS(*tarPath)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+		fsys = tfs
+
+		if len(*dir) == 0 {
+			*dir = "."
+		}
+	}
+
+	newHash, err := lookupHash(*hashName)
+	if err != nil {
 		log.Print(err.Error())
 		os.Exit(1)
 	}
+
+	if len(*check) > 0 {
+		ok, err := runVerify(fsys, *dir, *check, newHash, *missingOnSrc, *missingOnDst, f)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var resumeState map[string]stateEntry
+	var writer *stateWriter
+	if len(*statePath) > 0 {
+		if *resume {
+			resumeState, err = loadStateFile(*statePath)
+			if err != nil {
+				log.Print(err.Error())
+				os.Exit(1)
+			}
+		}
+
+		writer, err = newStateWriter(*statePath)
+		if err != nil {
+			log.Print(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	runErr := runChecks(fsys, *dir, *hashName, newHash, *numWorkers, f, resumeState, writer)
+
+	if writer != nil {
+		if err := writer.close(); err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+
+	if runErr != nil {
+		log.Print(runErr.Error())
+		os.Exit(1)
+	}
+}
+
+// lookupHash looks up a hash.Hash constructor by the name accepted by
+// -hash.
+func lookupHash(name string) (func() hash.Hash, error) {
+	newHash, ok := hashAlgorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm: %s", name)
+	}
+	return newHash, nil
 }
 
 // runChecks finds and then computes a checksum and reports each file under
-// the given directory.
-func runChecks(dir string) error {
+// the given directory on fsys.
+//
+// If resume is non-nil, a file whose size and mtime match its entry, and
+// whose entry was hashed with hashName, is reported using the recorded
+// checksum instead of being re-hashed. If
+// writer is non-nil, every checksum computed (not resumed) is recorded
+// through it as it completes.
+func runChecks(fsys FS, dir, hashName string, newHash func() hash.Hash, numWorkers int, f *filter, resume map[string]stateEntry, writer *stateWriter) error {
 	// Find the files to check.
-	files, err := findFiles(dir)
+	files, err := findFiles(fsys, dir, f)
 	if err != nil {
 		return err
 	}
 
-	sort.Strings(files)
+	sort.Slice(files, func(i, j int) bool { return files[i].rel < files[j].rel })
+
+	fmt.Printf("%s%s\n", headerPrefix, hashName)
 
 	// Compute and output checksums.
-	return computeAndOutputChecksums(files, dir)
+	return computeAndOutputChecksums(fsys, files, newHash, hashName, numWorkers, resume, writer)
+}
+
+// runVerify walks dir, computes a checksum for each file found that the file
+// at checkFile lists, and compares the results against the checksums
+// recorded there. Files it does not list are reported as EXTRA unhashed.
+//
+// If checkFile has a header line recording the hash algorithm it was
+// produced with, that algorithm is used instead of newHash.
+//
+// It reports MISSING, EXTRA, and CHANGED entries to stdout and returns
+// whether the tree matched (no mismatches of a type the caller asked to
+// see).
+func runVerify(fsys FS, dir, checkFile string, newHash func() hash.Hash, missingOnSrc, missingOnDst bool, f *filter) (bool, error) {
+	wanted, headerHashName, err := loadChecksumFile(checkFile)
+	if err != nil {
+		return false, err
+	}
+
+	if len(headerHashName) > 0 {
+		newHash, err = lookupHash(headerHashName)
+		if err != nil {
+			return false, fmt.Errorf("checksum file %s: %s", checkFile, err.Error())
+		}
+	}
+
+	files, err := findFiles(fsys, dir, f)
+	if err != nil {
+		return false, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].rel < files[j].rel })
+
+	seen := make(map[string]bool, len(files))
+
+	ok := true
+
+	reader := bufio.NewReader(nil)
+
+	for _, file := range files {
+		outputFilename := file.rel
+
+		seen[outputFilename] = true
+
+		wantHex, found := wanted[outputFilename]
+		if !found {
+			if missingOnSrc {
+				fmt.Printf("EXTRA: %s\n", outputFilename)
+				ok = false
+			}
+			continue
+		}
+
+		gotHex, err := hashFile(fsys, file.abs, newHash, reader)
+		if err != nil {
+			return false, err
+		}
+
+		if gotHex != wantHex {
+			fmt.Printf("CHANGED: %s\n", outputFilename)
+			ok = false
+		}
+	}
+
+	if missingOnDst {
+		// Anything we were told about but never saw while walking dir.
+		var missing []string
+		for outputFilename := range wanted {
+			if !seen[outputFilename] {
+				missing = append(missing, outputFilename)
+			}
+		}
+		sort.Strings(missing)
+		for _, outputFilename := range missing {
+			fmt.Printf("MISSING: %s\n", outputFilename)
+			ok = false
+		}
+	}
+
+	return ok, nil
+}
+
+// loadChecksumFile reads a checksum file and returns a map of filename to
+// hex checksum, along with the hash algorithm name recorded in its header
+// line (empty if the file has none, as with sha1sum/md5sum output).
+//
+// It understands this program's own "<path>: <hex>" output as well as the
+// GNU sha1sum/md5sum "<hex>  <path>" format (including a leading "*" before
+// the path, which those tools use to mark binary mode).
+func loadChecksumFile(path string) (sums map[string]string, hashName string, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to open checksum file: %s: %s", path,
+			err.Error())
+	}
+	defer func() { _ = fh.Close() }()
+
+	sums = map[string]string{}
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, headerPrefix) {
+			hashName = strings.TrimPrefix(line, headerPrefix)
+			continue
+		}
+
+		filename, hex, ok := parseChecksumLine(line)
+		if !ok {
+			return nil, "", fmt.Errorf("unable to parse checksum line: %q", line)
+		}
+
+		sums[normalizeChecksumPath(filename)] = hex
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", fmt.Errorf("unable to read checksum file: %s: %s", path,
+			err.Error())
+	}
+
+	return sums, hashName, nil
+}
+
+// parseChecksumLine parses a single line of a checksum file, returning the
+// filename and hex checksum it names.
+//
+// It supports this program's own "<path>: <hex>" format and the GNU
+// sha1sum/md5sum "<hex> <path>" and "<hex> *<path>" formats.
+func parseChecksumLine(line string) (filename string, hexChecksum string, ok bool) {
+	// Our own format: "<path>: <hex>".
+	if idx := strings.LastIndex(line, ": "); idx != -1 {
+		return line[:idx], line[idx+2:], true
+	}
+
+	// GNU format: "<hex>  <path>" or "<hex> *<path>" (single or double space).
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+
+	hexChecksum = fields[0]
+	filename = strings.TrimPrefix(strings.TrimPrefix(fields[1], " "), "*")
+	if len(hexChecksum) == 0 || len(filename) == 0 {
+		return "", "", false
+	}
+
+	return filename, hexChecksum, true
+}
+
+// normalizeChecksumPath strips a leading "/" or "./" from a filename read
+// from a checksum file, matching the root-relative, no-leading-slash
+// convention this program's output and GNU sha1sum/md5sum's output both
+// use. Without this, a checksum file produced some other way (or by hand)
+// with one of those conventions would never match the names findFiles
+// produces, and every file would show up as MISSING and EXTRA.
+func normalizeChecksumPath(filename string) string {
+	filename = strings.TrimPrefix(filename, "/")
+	filename = strings.TrimPrefix(filename, "./")
+	return filename
+}
+
+// foundFile is a file found by findFiles: its path as passed to fsys, and
+// the path relative to the root findFiles was called with, which is what
+// gets printed and matched against a checksum file. rel is always
+// slash-separated with no leading "/" or "./", matching the convention
+// sha1sum/md5sum use, regardless of what root looked like.
+type foundFile struct {
+	abs string
+	rel string
+}
+
+// findFiles recursively descends a directory tree on fsys and collects all
+// regular files not excluded by f. f may be nil to collect everything.
+func findFiles(fsys FS, root string, f *filter) ([]foundFile, error) {
+	return findFilesRel(fsys, root, "", f)
 }
 
-// findFiles recursively descends a directory tree and collects all regular
-// files.
-func findFiles(file string) ([]string, error) {
-	// Open the file.
+// findFilesRel does the work of findFiles. absPath is the path to stat/read
+// on fsys; relPath is the same path relative to the root findFiles was
+// called with ("" at the root), and is what f matches against and what
+// ends up in foundFile.rel.
+func findFilesRel(fsys FS, absPath, relPath string, f *filter) ([]foundFile, error) {
+	// Stat the file.
 	// If it is a regular file, record it.
 	// If it is a directory, recursively find files.
 	// Otherwise, skip it.
 
-	fh, err := os.Open(file)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open: %s: %s", file, err.Error())
+	if len(relPath) > 0 && f.skip(relPath) {
+		return nil, nil
 	}
 
-	fi, err := fh.Stat()
+	fi, err := fsys.Stat(absPath)
 	if err != nil {
-		_ = fh.Close()
-		return nil, fmt.Errorf("unable to stat: %s: %s", file, err.Error())
+		return nil, fmt.Errorf("unable to stat: %s: %s", absPath, err.Error())
 	}
 
-	var files []string
+	var files []foundFile
 	if fi.Mode().IsRegular() {
-		files = append(files, file)
-		_ = fh.Close()
+		rel := relPath
+		if len(rel) == 0 {
+			// root itself is a regular file, not a directory.
+			rel = path.Base(absPath)
+		}
+		files = append(files, foundFile{abs: absPath, rel: rel})
 		return files, nil
 	}
 
 	if fi.IsDir() {
-		names, err := fh.Readdirnames(0)
+		names, err := fsys.ReadDir(absPath)
 		if err != nil {
-			_ = fh.Close()
-			return nil, fmt.Errorf("unable to read directory files: %s: %s", file,
+			return nil, fmt.Errorf("unable to read directory files: %s: %s", absPath,
 				err.Error())
 		}
-		_ = fh.Close()
 
 		for _, name := range names {
-			absName := filepath.Join(file, name)
-			subFiles, err := findFiles(absName)
+			childAbs := path.Join(absPath, name)
+			childRel := path.Join(relPath, name)
+			subFiles, err := findFilesRel(fsys, childAbs, childRel, f)
 			if err != nil {
 				return nil, err
 			}
@@ -102,36 +467,127 @@ func findFiles(file string) ([]string, error) {
 		return files, nil
 	}
 
-	log.Printf("Ignoring non-regular and non-directory file: %s", file)
+	log.Printf("Ignoring non-regular and non-directory file: %s", absPath)
 	return files, nil
 }
 
-// computeAndOutputChecksums computes a checksum for a file, and then
-// outputs it along with its filename.
-//
-// Before outputting the filename, it strips the given root directory
-// prefix.
-func computeAndOutputChecksums(files []string, prefix string) error {
-	for _, filename := range files {
-		fh, err := os.Open(filename)
-		if err != nil {
-			return err
+// computeAndOutputChecksums computes a checksum for each file using up to
+// numWorkers goroutines, and then outputs each one along with its rel path.
+// Output is in the same order as files regardless of the order in which
+// workers finish hashing. See runChecks for resume and writer.
+func computeAndOutputChecksums(fsys FS, files []foundFile, newHash func() hash.Hash, hashName string, numWorkers int, resume map[string]stateEntry, writer *stateWriter) error {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	type outcome struct {
+		outputFilename string
+		hexChecksum    string
+		err            error
+	}
+
+	paths := make(chan int)
+	outcomes := make([]outcome, len(files))
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Reused across files by each worker to avoid a bufio.NewReader
+			// allocation per file.
+			reader := bufio.NewReader(nil)
+
+			for index := range paths {
+				file := files[index]
+
+				hexChecksum, err := computeChecksum(fsys, file.abs, file.rel,
+					newHash, hashName, reader, resume, writer)
+				outcomes[index] = outcome{
+					outputFilename: file.rel,
+					hexChecksum:    hexChecksum,
+					err:            err,
+				}
+			}
+		}()
+	}
+
+	for i := range files {
+		paths <- i
+	}
+	close(paths)
+
+	wg.Wait()
+
+	for _, outcome := range outcomes {
+		if outcome.err != nil {
+			return outcome.err
 		}
 
-		reader := bufio.NewReader(fh)
+		fmt.Printf("%s: %s\n", outcome.outputFilename, outcome.hexChecksum)
+	}
+
+	return nil
+}
 
-		hasher := md5.New()
+// computeChecksum returns the checksum for filename, resuming from resume
+// if it has an up-to-date entry for outputFilename hashed with the same
+// algorithm, and otherwise hashing it and, if writer is non-nil, recording
+// the result through it. resume and writer may each be nil to disable
+// resuming and recording respectively.
+func computeChecksum(fsys FS, filename, outputFilename string, newHash func() hash.Hash, hashName string, reader *bufio.Reader, resume map[string]stateEntry, writer *stateWriter) (string, error) {
+	var fi FileInfo
+	if resume != nil || writer != nil {
+		var err error
+		fi, err = fsys.Stat(filename)
+		if err != nil {
+			return "", err
+		}
 
-		if _, err = reader.WriteTo(hasher); err != nil {
-			_ = fh.Close()
-			return err
+		if resume != nil {
+			if entry, ok := resume[outputFilename]; ok && entry.hashName == hashName &&
+				entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+				return entry.hex, nil
+			}
 		}
-		_ = fh.Close()
+	}
 
-		outputFilename := strings.TrimPrefix(filename, prefix)
+	hexChecksum, err := hashFile(fsys, filename, newHash, reader)
+	if err != nil {
+		return "", err
+	}
 
-		fmt.Printf("%s: %x\n", outputFilename, hasher.Sum(nil))
+	if writer != nil {
+		writer.record(outputFilename, stateEntry{
+			size:     fi.Size(),
+			modTime:  fi.ModTime(),
+			hashName: hashName,
+			hex:      hexChecksum,
+		})
 	}
 
-	return nil
+	return hexChecksum, nil
+}
+
+// hashFile computes a hex checksum for the file at path on fsys using the
+// hash returned by newHash. reader is reset to read from the file and
+// reused, so callers hashing many files should keep passing the same one
+// back in.
+func hashFile(fsys FS, path string, newHash func() hash.Hash, reader *bufio.Reader) (string, error) {
+	fh, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = fh.Close() }()
+
+	reader.Reset(fh)
+
+	hasher := newHash()
+
+	if _, err := reader.WriteTo(hasher); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }